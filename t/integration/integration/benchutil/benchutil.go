@@ -0,0 +1,205 @@
+// Package benchutil provides shared helpers for ashuffle's integration
+// benchmarks: collecting percentile statistics from a set of samples,
+// persisting them as JSON for later comparison, and checking a new run
+// against a previous baseline for regressions.
+package benchutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/montanaflynn/stats"
+)
+
+// DefaultRegressionRatio is the fraction by which a percentile may grow,
+// relative to the baseline, before it is considered a regression.
+const DefaultRegressionRatio = 0.15
+
+// Result captures the percentile and variance statistics for a single set
+// of benchmark samples (e.g. one TestFastStartup sub-test).
+type Result struct {
+	Name    string    `json:"name"`
+	Samples []float64 `json:"samples"`
+	P50     float64   `json:"p50"`
+	P90     float64   `json:"p90"`
+	P95     float64   `json:"p95"`
+	P99     float64   `json:"p99"`
+	StdDev  float64   `json:"stddev"`
+}
+
+// Collect computes a Result from the given millisecond samples.
+func Collect(name string, samplesMs []float64) (Result, error) {
+	res := Result{Name: name, Samples: samplesMs}
+	percentiles := []struct {
+		dst *float64
+		pct float64
+	}{
+		{&res.P50, 50},
+		{&res.P90, 90},
+		{&res.P95, 95},
+		{&res.P99, 99},
+	}
+	for _, p := range percentiles {
+		v, err := stats.Percentile(samplesMs, p.pct)
+		if err != nil {
+			return Result{}, fmt.Errorf("failed to calculate p%v: %w", p.pct, err)
+		}
+		*p.dst = v
+	}
+	stddev, err := stats.StandardDeviation(samplesMs)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to calculate stddev: %w", err)
+	}
+	res.StdDev = stddev
+	return res, nil
+}
+
+// WriteJSON writes the result as JSON to the given path. If path is empty,
+// WriteJSON is a no-op, since $ASHUFFLE_BENCH_OUT is optional.
+func WriteJSON(path string, res Result) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("couldn't create %q: %w", path, err)
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(res); err != nil {
+		return fmt.Errorf("couldn't encode result to %q: %w", path, err)
+	}
+	return nil
+}
+
+// LoadJSON reads back a Result previously written by WriteJSON.
+func LoadJSON(path string) (Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Result{}, fmt.Errorf("couldn't open %q: %w", path, err)
+	}
+	defer f.Close()
+	var res Result
+	if err := json.NewDecoder(f).Decode(&res); err != nil {
+		return Result{}, fmt.Errorf("couldn't decode %q: %w", path, err)
+	}
+	return res, nil
+}
+
+// mannWhitneyU runs a two-sided Mann-Whitney U test on samples a and b,
+// returning the U statistic and the normal-approximation z-score (with tie
+// correction). Callers typically reject the null hypothesis (that a and b
+// are drawn from the same distribution) when |z| > 1.96, i.e. p < 0.05.
+func mannWhitneyU(a, b []float64) (u, z float64) {
+	na, nb := float64(len(a)), float64(len(b))
+
+	type sample struct {
+		value float64
+		group int // 0 for a, 1 for b
+	}
+	all := make([]sample, 0, len(a)+len(b))
+	for _, v := range a {
+		all = append(all, sample{v, 0})
+	}
+	for _, v := range b {
+		all = append(all, sample{v, 1})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].value < all[j].value })
+
+	// Assign ranks, averaging ranks across ties, and accumulate the tie
+	// correction term used by the normal approximation's variance.
+	ranks := make([]float64, len(all))
+	var tieCorrection float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].value == all[i].value {
+			j++
+		}
+		// Ranks are 1-indexed; all entries in [i, j) tie for ranks i+1..j.
+		avgRank := float64(i+1+j) / 2
+		for k := i; k < j; k++ {
+			ranks[k] = avgRank
+		}
+		tieCount := float64(j - i)
+		tieCorrection += tieCount*tieCount*tieCount - tieCount
+		i = j
+	}
+
+	var rankSumA float64
+	for i, s := range all {
+		if s.group == 0 {
+			rankSumA += ranks[i]
+		}
+	}
+
+	uA := rankSumA - na*(na+1)/2
+	uB := na*nb - uA
+	u = math.Min(uA, uB)
+
+	n := na + nb
+	meanU := na * nb / 2
+	variance := (na * nb / 12) * ((n + 1) - tieCorrection/(n*(n-1)))
+	if variance <= 0 {
+		return u, 0
+	}
+	z = (u - meanU) / math.Sqrt(variance)
+	return u, z
+}
+
+// Regression describes why a new Result was judged to be a regression
+// against a baseline.
+type Regression struct {
+	Percentile string
+	Baseline   float64
+	Current    float64
+	Z          float64
+}
+
+func (r Regression) String() string {
+	return fmt.Sprintf("%s regressed from %.2fms to %.2fms (z=%.2f)", r.Percentile, r.Baseline, r.Current, r.Z)
+}
+
+// CheckRegression compares cur against baseline, returning a Regression for
+// each percentile that grew by more than ratio (e.g. 0.15 for 15%) *and*
+// whose underlying sample sets differ significantly per a Mann-Whitney U
+// test (|z| > 1.96). Pass 0 for ratio to use DefaultRegressionRatio.
+func CheckRegression(baseline, cur Result, ratio float64) []Regression {
+	if ratio == 0 {
+		ratio = DefaultRegressionRatio
+	}
+
+	_, z := mannWhitneyU(baseline.Samples, cur.Samples)
+	if math.Abs(z) <= 1.96 {
+		// The two sample sets aren't significantly different; any percentile
+		// delta is noise.
+		return nil
+	}
+
+	percentiles := []struct {
+		name         string
+		base, curVal float64
+	}{
+		{"p50", baseline.P50, cur.P50},
+		{"p90", baseline.P90, cur.P90},
+		{"p95", baseline.P95, cur.P95},
+		{"p99", baseline.P99, cur.P99},
+	}
+
+	var regressions []Regression
+	for _, p := range percentiles {
+		if p.base <= 0 {
+			continue
+		}
+		if (p.curVal-p.base)/p.base > ratio {
+			regressions = append(regressions, Regression{
+				Percentile: p.name,
+				Baseline:   p.base,
+				Current:    p.curVal,
+				Z:          z,
+			})
+		}
+	}
+	return regressions
+}
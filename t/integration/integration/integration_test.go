@@ -17,9 +17,9 @@ import (
 
 	"ashuffle/ashuffle"
 	"ashuffle/mpd"
+	"ashuffle/t/integration/integration/benchutil"
 
 	"github.com/google/go-cmp/cmp"
-	"github.com/montanaflynn/stats"
 	"golang.org/x/sync/semaphore"
 )
 
@@ -515,10 +515,74 @@ func TestPassword(t *testing.T) {
 	mpdi.Shutdown()
 }
 
+// collectStartupSamples starts `trials` ashuffle instances against a fresh
+// MPD instance each, up to `parallelism` at a time, and returns each
+// instance's startup time, in milliseconds.
+func collectStartupSamples(t *testing.T, ctx context.Context, parallelism, trials int, args []string) []float64 {
+	t.Helper()
+
+	sem := semaphore.NewWeighted(int64(parallelism))
+	wg := new(sync.WaitGroup)
+	ch := make(chan time.Duration)
+
+	runOnce := func() {
+		sem.Acquire(ctx, 1)
+		defer wg.Done()
+		defer sem.Release(1)
+
+		mpdi, err := mpd.New(ctx, &mpd.Options{LibraryRoot: "/music.huge"})
+		if err != nil {
+			t.Fatalf("failed to create new MPD instance: %v", err)
+		}
+		defer mpdi.Shutdown()
+
+		start := time.Now()
+		as, err := ashuffle.New(ctx, ashuffleBin, &ashuffle.Options{
+			MPDAddress: mpdi,
+			Args:       args,
+		})
+		if err != nil {
+			t.Fatalf("failed to create new ashuffle instance")
+		}
+
+		if err := as.Shutdown(ashuffle.ShutdownSoft); err != nil {
+			t.Fatalf("ashuffle did not shut down cleanly: %v", err)
+		}
+		ch <- time.Since(start)
+
+		if !mpdi.IsOk() {
+			t.Fatalf("mpd communication error: %v", mpdi.Errors)
+		}
+	}
+
+	for i := 0; i < trials; i++ {
+		wg.Add(1)
+		go runOnce()
+	}
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	var samplesMs []float64
+	for result := range ch {
+		samplesMs = append(samplesMs, float64(result.Milliseconds()))
+	}
+	return samplesMs
+}
+
 // TestFastStartup verifies that ashuffle can load the "huge" music
 // library (see the ashuffle root container for details of how it is created)
 // and startup within a set threshold. This test is designed to detect
 // performance regresssions in ashuffle startup.
+//
+// Beyond the fixed threshold, this test also acts as a regression-detection
+// harness: each run's percentile statistics are written to
+// $ASHUFFLE_BENCH_OUT (if set), and if $ASHUFFLE_BENCH_BASELINE points at a
+// previous run's JSON, the current run is compared against it via
+// benchutil.CheckRegression, see that package for the regression criteria.
+//
 // This test closely mirrors the "ShuffleOnce" test.
 func TestFastStartup(t *testing.T) {
 	// No t.Parallel(), since this benchmark is performance sensitive. We want
@@ -554,7 +618,6 @@ func TestFastStartup(t *testing.T) {
 	tests := []struct {
 		name string
 		args []string
-		once func(*testing.T) time.Duration
 	}{
 		{
 			name: "from mpd",
@@ -576,63 +639,94 @@ func TestFastStartup(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			sem := semaphore.NewWeighted(int64(parallelism))
-			wg := new(sync.WaitGroup)
-			ch := make(chan time.Duration)
+			samplesMs := collectStartupSamples(t, ctx, parallelism, trials, test.args)
 
-			runOnce := func() {
-				sem.Acquire(ctx, 1)
-				defer wg.Done()
-				defer sem.Release(1)
+			res, err := benchutil.Collect(test.name, samplesMs)
+			if err != nil {
+				t.Fatalf("failed to collect startup samples: %v", err)
+			}
 
-				mpdi, err := mpd.New(ctx, &mpd.Options{LibraryRoot: "/music.huge"})
-				if err != nil {
-					t.Fatalf("failed to create new MPD instance: %v", err)
+			if d95 := time.Duration(res.P95) * time.Millisecond; d95 > threshold {
+				t.Errorf("ashuffle took %v to startup, want %v or less.", d95, threshold)
+			}
+
+			if outPath := os.Getenv("ASHUFFLE_BENCH_OUT"); outPath != "" {
+				if err := benchutil.WriteJSON(outPath, res); err != nil {
+					t.Errorf("failed to write bench results to %q: %v", outPath, err)
 				}
-				defer mpdi.Shutdown()
+			}
 
-				start := time.Now()
-				as, err := ashuffle.New(ctx, ashuffleBin, &ashuffle.Options{
-					MPDAddress: mpdi,
-					Args:       test.args,
-				})
+			if baselinePath := os.Getenv("ASHUFFLE_BENCH_BASELINE"); baselinePath != "" {
+				baseline, err := benchutil.LoadJSON(baselinePath)
 				if err != nil {
-					t.Fatalf("failed to create new ashuffle instance")
+					t.Fatalf("failed to load bench baseline from %q: %v", baselinePath, err)
 				}
-
-				if err := as.Shutdown(ashuffle.ShutdownSoft); err != nil {
-					t.Fatalf("ashuffle did not shut down cleanly: %v", err)
-				}
-				ch <- time.Since(start)
-
-				if !mpdi.IsOk() {
-					t.Fatalf("mpd communication error: %v", mpdi.Errors)
+				for _, regression := range benchutil.CheckRegression(baseline, res, 0) {
+					t.Errorf("startup time regressed against baseline: %s", regression)
 				}
 			}
+		})
+	}
+}
 
-			for i := 0; i < trials; i++ {
-				wg.Add(1)
-				go runOnce()
-			}
+// TestFastStartupRegressionDetection exercises the baseline-comparison path
+// of benchutil directly, using a synthetic baseline, so that a real
+// regression in startup time isn't the only way to notice that the
+// regression detector itself is broken.
+func TestFastStartupRegressionDetection(t *testing.T) {
+	t.Parallel()
 
-			go func() {
-				wg.Wait()
-				close(ch)
-			}()
+	baselineSamples := make([]float64, 100)
+	for i := range baselineSamples {
+		baselineSamples[i] = 100 + float64(i%10)
+	}
+	baseline, err := benchutil.Collect("synthetic baseline", baselineSamples)
+	if err != nil {
+		t.Fatalf("failed to collect synthetic baseline: %v", err)
+	}
 
-			var runtimesMs []float64
-			for result := range ch {
-				runtimesMs = append(runtimesMs, float64(result.Milliseconds()))
-			}
+	baselineF, err := ioutil.TempFile(os.TempDir(), "ashuffle-bench-baseline")
+	if err != nil {
+		t.Fatalf("couldn't create baseline tempfile: %v", err)
+	}
+	defer os.Remove(baselineF.Name())
+	defer baselineF.Close()
 
-			pct95, err := stats.Percentile(runtimesMs, 95)
-			if err != nil {
-				t.Fatalf("failed to calculate 95th percentile: %v", err)
-			}
+	if err := benchutil.WriteJSON(baselineF.Name(), baseline); err != nil {
+		t.Fatalf("failed to write synthetic baseline: %v", err)
+	}
 
-			if d95 := time.Duration(pct95) * time.Millisecond; d95 > threshold {
-				t.Errorf("ashuffle took %v to startup, want %v or less.", d95, threshold)
-			}
-		})
+	loaded, err := benchutil.LoadJSON(baselineF.Name())
+	if err != nil {
+		t.Fatalf("failed to load synthetic baseline: %v", err)
+	}
+
+	// A clear, consistent regression: every sample doubled.
+	regressedSamples := make([]float64, 100)
+	for i := range regressedSamples {
+		regressedSamples[i] = 2 * baselineSamples[i]
+	}
+	regressed, err := benchutil.Collect("synthetic regressed run", regressedSamples)
+	if err != nil {
+		t.Fatalf("failed to collect synthetic regressed run: %v", err)
+	}
+	if regressions := benchutil.CheckRegression(loaded, regressed, 0); len(regressions) == 0 {
+		t.Errorf("want regressions reported for a doubled sample set, got none")
+	}
+
+	// A small shift (+1ms), well within the default ratio, should not be
+	// reported as a regression. The Mann-Whitney test does find this shift
+	// significant (z is about -2.33), so it is the ratio check that keeps it
+	// from being reported.
+	noisySamples := make([]float64, 100)
+	for i := range noisySamples {
+		noisySamples[i] = baselineSamples[i] + 1
+	}
+	noisy, err := benchutil.Collect("synthetic noisy run", noisySamples)
+	if err != nil {
+		t.Fatalf("failed to collect synthetic noisy run: %v", err)
+	}
+	if regressions := benchutil.CheckRegression(loaded, noisy, 0); len(regressions) != 0 {
+		t.Errorf("want no regressions reported for noise within tolerance, got: %v", regressions)
 	}
 }